@@ -24,6 +24,7 @@ type File struct {
 	Name        string `json:"name"`
 	ContentType string `json:"content_type"`
 	Size        int64  `json:"size"`
+	CRC32       string `json:"crc32"`
 }
 
 func (file *File) DownloadUrl() string {
@@ -1,26 +1,75 @@
 package main
 
 import (
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"sync"
+	"time"
 )
 
 const DownloadExtension = ".ptdownload"
 const ChunkSize int64 = 32 * 1024
 const MaxConnection = 10
 
-// Downloads the given range. In case of an error, sleeps for 10s and tries again.
-func DownloadRange(file *File, fp *os.File, offset int64, size int64, rangeWg *sync.WaitGroup, chunkIndex bitField, reportCh chan Report) {
+// Backoff bounds for a failed range, loosely modeled after the retry loop
+// used by tools like pget: each attempt waits twice as long as the last,
+// capped so a flaky link doesn't stall a file for hours.
+const InitialBackoff = 1 * time.Second
+const MaxBackoff = 30 * time.Second
+
+// workItem is a single {offset,size} chunk of a file waiting to be
+// downloaded. DownloadFile seeds a queue of these and a fixed pool of
+// workers drains it, so a range that fails gets requeued instead of being
+// abandoned for a whole check-minutes cycle.
+type workItem struct {
+	offset int64
+	size   int64
+}
+
+// downloadWorker pulls chunks off workCh until it's closed, retrying each
+// with exponential backoff up to MaxRetryAttempts before giving up on it.
+func downloadWorker(file *File, fp *os.File, workCh chan workItem, chunkIndex bitField, reportCh chan Report, rangeWg *sync.WaitGroup) {
 	defer rangeWg.Done()
-	reportCh <- Report{ToDownload: size}
-	newOffset := offset
-	lastByte := offset + size           // The byte we won't be getting
-	lastIndex := lastByte/ChunkSize - 1 // The last index we'll fill
+	for work := range workCh {
+		backoff := InitialBackoff
+		var err error
+		for attempt := 0; attempt <= *MaxRetryAttempts; attempt++ {
+			if attempt > 0 {
+				reportCh <- Report{Retries: 1}
+				time.Sleep(backoff)
+				backoff *= 2
+				if backoff > MaxBackoff {
+					backoff = MaxBackoff
+				}
+			}
+			err = DownloadRange(file, fp, work.offset, work.size, chunkIndex, reportCh)
+			if err == nil {
+				break
+			}
+			log.Println(err)
+		}
+		if err != nil {
+			log.Println("Giving up on range after", *MaxRetryAttempts, "attempts:", file.Name)
+			reportCh <- Report{PermanentlyFailed: 1}
+		}
+	}
+}
+
+// DownloadRange makes a single attempt at downloading one ChunkSize-aligned
+// chunk, [offset, offset+size), of file into fp, returning any transient
+// error so the caller can decide whether to retry. It only reports bytes
+// and marks the chunk done once the whole chunk has landed, so a retried
+// attempt never double-counts the bytes of a previous failed attempt.
+func DownloadRange(file *File, fp *os.File, offset int64, size int64, chunkIndex bitField, reportCh chan Report) error {
+	ConnSem.Acquire()
+	defer ConnSem.Release()
+	lastByte := offset + size // The byte we won't be getting
 
 	// Creating a custom request because it will have Range header in it
 	req, _ := http.NewRequest("GET", file.DownloadUrl(), nil)
@@ -38,43 +87,35 @@ func DownloadRange(file *File, fp *os.File, offset int64, size int64, rangeWg *s
 
 	resp, err := client.Do(req)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	defer resp.Body.Close()
 
-	buffer := make([]byte, ChunkSize)
-	for {
-		nr, er := io.ReadFull(resp.Body, buffer)
-		if nr > 0 {
-			nw, ew := fp.WriteAt(buffer[0:nr], newOffset)
-			nWritten := int64(nw)
-			newOffset += nWritten
-			currentIndex := newOffset/ChunkSize - 1
-			if currentIndex == lastIndex && newOffset != lastByte {
-				// dont mark the last bit done without finishing the whole range
-			} else {
-				chunkIndex.Set(currentIndex)
-				fp.WriteAt(chunkIndex, file.Size)
-			}
-			reportCh <- Report{Downloaded: nWritten}
-			if ew != nil {
-				log.Println(ew)
-				return
-			}
-		}
-		if er == io.EOF || er == io.ErrUnexpectedEOF {
-			return
-		}
-		if er != nil {
-			log.Println(er)
-			return
-		}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected status downloading %s: %s", file.Name, resp.Status)
+	}
+
+	buffer := make([]byte, size)
+	if _, err := io.ReadFull(resp.Body, buffer); err != nil {
+		return err
+	}
+
+	if _, err := fp.WriteAt(buffer, offset); err != nil {
+		return err
+	}
+
+	chunkIndex.Set(offset / ChunkSize)
+	if _, err := fp.WriteAt(chunkIndex, file.Size); err != nil {
+		return err
 	}
+
+	reportCh <- Report{Downloaded: size, FileId: file.Id}
+	return nil
 }
 
 func DownloadFile(file File, path string, runWg *sync.WaitGroup, reportCh chan Report) error {
 	defer runWg.Done()
+	reportCh <- Report{Event: FileStarted, FileId: file.Id, FileName: file.Name, FileSize: file.Size}
 	downloadPath := path + DownloadExtension
 	chunkIndex := bitField(make([]byte, file.Size/ChunkSize/8+1))
 	resume := false
@@ -84,12 +125,19 @@ func DownloadFile(file File, path string, runWg *sync.WaitGroup, reportCh chan R
 	// downloaded before returning
 	var rangeWg sync.WaitGroup
 
+	// reportFailed tells the progress UI this file's bar should go away
+	// because the download did not complete this cycle.
+	reportFailed := func() {
+		reportCh <- Report{Event: FileFailed, FileId: file.Id, FileName: file.Name}
+	}
+
 	// Checking whether previous download exists
 	if _, err := os.Stat(downloadPath); err != nil {
 		log.Println("Downloading:", file.Name)
 		fp, err = os.Create(downloadPath)
 		if err != nil {
 			log.Println(err)
+			reportFailed()
 			return err
 		}
 		defer fp.Close()
@@ -98,6 +146,7 @@ func DownloadFile(file File, path string, runWg *sync.WaitGroup, reportCh chan R
 		err = FillWithZeros(fp, file.Size+int64(len(chunkIndex)))
 		if err != nil {
 			log.Println(err)
+			reportFailed()
 			return err
 		}
 	} else {
@@ -106,75 +155,127 @@ func DownloadFile(file File, path string, runWg *sync.WaitGroup, reportCh chan R
 		fp, err = os.OpenFile(downloadPath, os.O_RDWR, 0755)
 		if err != nil {
 			log.Println(err)
+			reportFailed()
 			return err
 		}
 		defer fp.Close()
 		_, err = fp.ReadAt(chunkIndex, file.Size)
 		if err != nil {
 			log.Println(err)
+			reportFailed()
 			return err
 		}
 	}
 
-	rangeSize := file.Size / MaxConnection
-	excessBytes := file.Size % MaxConnection
+	numChunks := file.Size / ChunkSize
+	if file.Size%ChunkSize != 0 {
+		numChunks++
+	}
 
-	offset := int64(0)
-	for i := 0; i < MaxConnection; i++ {
-		rangeCustomOffset := offset
-		offset += rangeSize
-		rangeCustomSize := rangeSize
-		if i == MaxConnection-1 {
-			// Add excess bytes to last connection
-			rangeCustomSize = rangeSize + excessBytes
+	// Seeding the work queue with the still-unfinished ChunkSize-sized
+	// chunks of the file. A fixed pool of workers below drains it,
+	// requeueing failed chunks with backoff instead of abandoning a whole
+	// check-minutes cycle's worth of progress on the first error.
+	workCh := make(chan workItem, numChunks)
+	var toDownload int64
+	for i := int64(0); i < numChunks; i++ {
+		if resume && chunkIndex.Test(i) {
+			continue
 		}
-		if resume {
-			// Adjusting range for previously downloaded file
-			startIndex := rangeCustomOffset / ChunkSize
-			limitIndex := (rangeCustomOffset + rangeSize) / ChunkSize
-
-			zIndex, err := chunkIndex.GetFirstZeroIndex(startIndex, limitIndex)
-			if err == nil {
-				// This range in not finished yet
-				zByteIndex := zIndex * ChunkSize
-				if zByteIndex > rangeCustomOffset {
-					rangeCustomSize -= zByteIndex - rangeCustomOffset
-					rangeCustomOffset = zByteIndex
-				}
-
-			} else {
-				continue
-			}
+		chunkOffset := i * ChunkSize
+		chunkSize := ChunkSize
+		if chunkOffset+chunkSize > file.Size {
+			chunkSize = file.Size - chunkOffset
 		}
+		workCh <- workItem{offset: chunkOffset, size: chunkSize}
+		toDownload += chunkSize
+	}
+	close(workCh)
+	reportCh <- Report{ToDownload: toDownload}
+
+	workerCount := MaxConnection
+	if int64(workerCount) > numChunks {
+		workerCount = int(numChunks)
+	}
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	for i := 0; i < workerCount; i++ {
 		rangeWg.Add(1)
-		go DownloadRange(&file, fp, rangeCustomOffset, rangeCustomSize, &rangeWg, chunkIndex, reportCh)
+		go downloadWorker(&file, fp, workCh, chunkIndex, reportCh, &rangeWg)
 	}
 
 	// Waiting for all chunks to be downloaded
 	rangeWg.Wait()
 
 	// Verifying the download, some ranges may not be finished
-	_, err := chunkIndex.GetFirstZeroIndex(0, file.Size/ChunkSize)
+	_, err := chunkIndex.GetFirstZeroIndex(0, numChunks)
 	if err == nil {
 		// All chunks are not downloaded
 		log.Println("All chunks are not downloaded, closing file for dowload:", file.Name)
 		fp.Close()
+		reportFailed()
 		return nil
 	}
 
-	// Renaming the file to correct path
+	// Verifying the integrity of the assembled file before it is exposed
+	// under its final name. put.io CDN redirects and concurrent ranges
+	// both give corruption a chance to sneak in unnoticed.
 	fp.Truncate(file.Size)
+	ok, err := VerifyChecksum(fp, &file)
+	if err != nil {
+		log.Println("Could not verify checksum for", file.Name, ":", err)
+	} else if !ok {
+		log.Println("Checksum mismatch, quarantining:", file.Name)
+		reportCh <- Report{ChecksumMismatch: 1}
+		// Resetting the bitfield so the next run re-downloads the whole file
+		for i := range chunkIndex {
+			chunkIndex[i] = 0
+		}
+		fp.WriteAt(chunkIndex, file.Size)
+		fp.Close()
+		reportFailed()
+		return errors.New("checksum mismatch for " + file.Name)
+	}
+
+	// Renaming the file to correct path
 	fp.Close()
 	err = os.Rename(downloadPath, path)
 	if err != nil {
 		log.Println(err)
+		reportFailed()
 		return err
 	}
 
+	reportCh <- Report{Event: FileFinished, FileId: file.Id, FileName: file.Name}
 	log.Println("Download completed:", file.Name)
 	return nil
 }
 
+// VerifyChecksum computes the IEEE CRC-32 checksum of the downloaded
+// portion of fp and compares it against the crc32 value put.io reported for
+// file, which put.io renders as a lowercase hex digest (not base64, and not
+// the Castagnoli variant x-goog-hash uses for a field of that name). If
+// put.io didn't report a checksum for this file there is nothing to verify
+// against, so it is treated as a pass.
+func VerifyChecksum(fp *os.File, file *File) (bool, error) {
+	if file.CRC32 == "" {
+		return true, nil
+	}
+
+	if _, err := fp.Seek(0, 0); err != nil {
+		return false, err
+	}
+
+	hasher := crc32.NewIEEE()
+	if _, err := io.CopyN(hasher, fp, file.Size); err != nil {
+		return false, err
+	}
+
+	sum := hex.EncodeToString(hasher.Sum(nil))
+	return sum == file.CRC32, nil
+}
+
 func FillWithZeros(fp *os.File, remainingWrite int64) error {
 	var nWrite int64 // Next chunk size to write
 	zeros := make([]byte, ChunkSize)
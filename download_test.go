@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// put.io reports crc32 as a lowercase hex digest of standard IEEE CRC-32,
+// not base64 and not the Castagnoli variant. This is the digest of the
+// 11-byte payload "hello world" (crc32.ChecksumIEEE, hex-encoded).
+const helloWorldCRC32Hex = "0d4a1185"
+
+func TestVerifyChecksumMatchesIEEEHex(t *testing.T) {
+	fp, err := ioutil.TempFile("", "putio-checksum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	payload := []byte("hello world")
+	if _, err := fp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	file := &File{Size: int64(len(payload)), CRC32: helloWorldCRC32Hex}
+
+	ok, err := VerifyChecksum(fp, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatalf("expected checksum %q to match payload %q", helloWorldCRC32Hex, payload)
+	}
+}
+
+func TestVerifyChecksumDetectsMismatch(t *testing.T) {
+	fp, err := ioutil.TempFile("", "putio-checksum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	payload := []byte("hello world")
+	if _, err := fp.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+
+	file := &File{Size: int64(len(payload)), CRC32: "deadbeef"}
+
+	ok, err := VerifyChecksum(fp, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Fatal("expected checksum mismatch to be detected")
+	}
+}
+
+func TestVerifyChecksumSkippedWhenAbsent(t *testing.T) {
+	fp, err := ioutil.TempFile("", "putio-checksum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fp.Name())
+	defer fp.Close()
+
+	file := &File{Size: 0, CRC32: ""}
+
+	ok, err := VerifyChecksum(fp, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("expected no reported crc32 to be treated as a pass")
+	}
+}
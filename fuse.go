@@ -0,0 +1,384 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// BlockSize is the granularity the FUSE file reads are cached and
+// fetched in, independent from ChunkSize used by the downloader's
+// bitfield.
+const BlockSize int64 = 1 * 1024 * 1024
+const ReadAheadBlocks = 4
+
+// RunFuseMount mounts the remote put.io folder at mountPath as a read-only
+// filesystem: directory listings come from FilesListRequest (cached with a
+// TTL), file reads are served on demand via ranged HTTP GETs backed by a
+// two-tier LRU block cache.
+func RunFuseMount(mountPath string) error {
+	c, err := fuse.Mount(mountPath, fuse.ReadOnly(), fuse.FSName("putio"), fuse.Subtype("putiofs"))
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	filesys := &FS{
+		dirs:  newDirCache(30 * time.Second),
+		cache: newBlockCache(*MaxCachedBlocksPerFile, *MaxCacheBytes),
+	}
+
+	log.Println("Mounted remote folder at", mountPath)
+	return fs.Serve(c, filesys)
+}
+
+// FS is the root of the mounted filesystem.
+type FS struct {
+	dirs  *dirCache
+	cache *blockCache
+}
+
+func (f *FS) Root() (fs.Node, error) {
+	return &Dir{fs: f, id: RemoteFolderId}, nil
+}
+
+// Dir is a remote folder, identified by its put.io file id.
+type Dir struct {
+	fs *FS
+	id int
+}
+
+func (d *Dir) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = os.ModeDir | 0555
+	return nil
+}
+
+func (d *Dir) Lookup(ctx context.Context, name string) (fs.Node, error) {
+	files, err := d.fs.dirs.list(d.id)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+
+	for _, file := range files {
+		if file.Name != name {
+			continue
+		}
+		if file.ContentType == "application/x-directory" {
+			return &Dir{fs: d.fs, id: file.Id}, nil
+		}
+		return &FileNode{fs: d.fs, file: file}, nil
+	}
+	return nil, fuse.ENOENT
+}
+
+func (d *Dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	files, err := d.fs.dirs.list(d.id)
+	if err != nil {
+		return nil, fuse.EIO
+	}
+
+	dirents := make([]fuse.Dirent, 0, len(files))
+	for _, file := range files {
+		entType := fuse.DT_File
+		if file.ContentType == "application/x-directory" {
+			entType = fuse.DT_Dir
+		}
+		dirents = append(dirents, fuse.Dirent{Inode: uint64(file.Id), Name: file.Name, Type: entType})
+	}
+	return dirents, nil
+}
+
+// FileNode is a remote file, read on demand through fs.cache.
+type FileNode struct {
+	fs   *FS
+	file File
+}
+
+func (f *FileNode) Attr(ctx context.Context, a *fuse.Attr) error {
+	a.Mode = 0444
+	a.Size = uint64(f.file.Size)
+	return nil
+}
+
+func (f *FileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	resp.Flags |= fuse.OpenKeepCache
+	return f, nil
+}
+
+func (f *FileNode) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	data, err := f.fs.cache.readRange(&f.file, req.Offset, int64(req.Size))
+	if err != nil {
+		return fuse.EIO
+	}
+	resp.Data = data
+	return nil
+}
+
+// dirCache memoizes FilesListRequest results for ttl, so browsing a large
+// tree doesn't re-list every folder on every Lookup/ReadDirAll.
+type dirCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	entries map[int]dirCacheEntry
+}
+
+type dirCacheEntry struct {
+	files     []File
+	fetchedAt time.Time
+}
+
+func newDirCache(ttl time.Duration) *dirCache {
+	return &dirCache{ttl: ttl, entries: map[int]dirCacheEntry{}}
+}
+
+func (d *dirCache) list(parentId int) ([]File, error) {
+	d.mu.Lock()
+	if entry, ok := d.entries[parentId]; ok && time.Since(entry.fetchedAt) < d.ttl {
+		d.mu.Unlock()
+		return entry.files, nil
+	}
+	d.mu.Unlock()
+
+	files, err := FilesListRequest(parentId)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mu.Lock()
+	d.entries[parentId] = dirCacheEntry{files: files, fetchedAt: time.Now()}
+	d.mu.Unlock()
+	return files, nil
+}
+
+// cacheKey identifies one block of one remote file.
+type cacheKey struct {
+	fileId int
+	block  int64
+}
+
+type cacheEntry struct {
+	key  cacheKey
+	data []byte
+}
+
+// blockCache is a two-tier LRU over BlockSize-sized file ranges: each file
+// keeps up to perFileCap resident blocks, and the cache as a whole evicts
+// the globally least-recently-used block once globalCap bytes are held.
+type blockCache struct {
+	mu          sync.Mutex
+	perFileCap  int
+	globalCap   int64
+	globalBytes int64
+	order       *list.List // most-recently-used at the front
+	index       map[cacheKey]*list.Element
+	perFile     map[int]int
+	lastBlock   map[int]int64 // last block index read per file, for detecting sequential access
+}
+
+func newBlockCache(perFileCap int, globalCap int64) *blockCache {
+	return &blockCache{
+		perFileCap: perFileCap,
+		globalCap:  globalCap,
+		order:      list.New(),
+		index:      map[cacheKey]*list.Element{},
+		perFile:    map[int]int{},
+		lastBlock:  map[int]int64{},
+	}
+}
+
+func (c *blockCache) get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.index[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*cacheEntry).data, true
+}
+
+func (c *blockCache) put(key cacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.index[key]; ok {
+		c.order.MoveToFront(el)
+		el.Value.(*cacheEntry).data = data
+		return
+	}
+
+	el := c.order.PushFront(&cacheEntry{key: key, data: data})
+	c.index[key] = el
+	c.perFile[key.fileId]++
+	c.globalBytes += int64(len(data))
+
+	for c.perFile[key.fileId] > c.perFileCap {
+		if !c.evictOldestForFile(key.fileId) {
+			break
+		}
+	}
+	for c.globalBytes > c.globalCap {
+		if !c.evictLRU() {
+			break
+		}
+	}
+}
+
+func (c *blockCache) evictOldestForFile(fileId int) bool {
+	for el := c.order.Back(); el != nil; el = el.Prev() {
+		if el.Value.(*cacheEntry).key.fileId == fileId {
+			c.removeElement(el)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *blockCache) evictLRU() bool {
+	el := c.order.Back()
+	if el == nil {
+		return false
+	}
+	c.removeElement(el)
+	return true
+}
+
+func (c *blockCache) removeElement(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.order.Remove(el)
+	delete(c.index, entry.key)
+	c.perFile[entry.key.fileId]--
+	c.globalBytes -= int64(len(entry.data))
+}
+
+// readRange returns [offset, offset+size) of file, fetching and caching any
+// blocks that aren't already resident, and kicks off read-ahead of the
+// blocks right after the ones just read.
+func (c *blockCache) readRange(file *File, offset int64, size int64) ([]byte, error) {
+	if offset >= file.Size {
+		return nil, nil
+	}
+	if offset+size > file.Size {
+		size = file.Size - offset
+	}
+
+	startBlock := offset / BlockSize
+	endBlock := (offset + size - 1) / BlockSize
+
+	out := make([]byte, 0, size)
+	for b := startBlock; b <= endBlock; b++ {
+		data, err := c.getOrFetch(file, b)
+		if err != nil {
+			return nil, err
+		}
+
+		blockStart := b * BlockSize
+		from := int64(0)
+		if offset > blockStart {
+			from = offset - blockStart
+		}
+		to := int64(len(data))
+		if blockEnd := blockStart + int64(len(data)); offset+size < blockEnd {
+			to = offset + size - blockStart
+		}
+		out = append(out, data[from:to]...)
+	}
+
+	if c.recordAccessIsSequential(file.Id, startBlock, endBlock) {
+		go c.readAhead(file, endBlock+1)
+	}
+	return out, nil
+}
+
+// recordAccessIsSequential reports whether [startBlock, endBlock] continues
+// directly from the last access this file made, and records endBlock as the
+// new high-water mark either way. Random access (scrubbing/seeking) is common
+// enough for the streaming case this cache serves that read-ahead should only
+// fire when it's actually likely to be used.
+func (c *blockCache) recordAccessIsSequential(fileId int, startBlock, endBlock int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	last, ok := c.lastBlock[fileId]
+	sequential := ok && startBlock == last+1
+	c.lastBlock[fileId] = endBlock
+	return sequential
+}
+
+func (c *blockCache) getOrFetch(file *File, blockIndex int64) ([]byte, error) {
+	key := cacheKey{fileId: file.Id, block: blockIndex}
+	if data, ok := c.get(key); ok {
+		return data, nil
+	}
+
+	data, err := fetchBlock(file, blockIndex)
+	if err != nil {
+		return nil, err
+	}
+	c.put(key, data)
+	return data, nil
+}
+
+func (c *blockCache) readAhead(file *File, fromBlock int64) {
+	for i := int64(0); i < ReadAheadBlocks; i++ {
+		b := fromBlock + i
+		if b*BlockSize >= file.Size {
+			return
+		}
+		if _, err := c.getOrFetch(file, b); err != nil {
+			return
+		}
+	}
+}
+
+// fetchBlock downloads a single BlockSize-sized range of file, the same way
+// DownloadRange does for the sync path, sharing its connection semaphore.
+func fetchBlock(file *File, blockIndex int64) ([]byte, error) {
+	start := blockIndex * BlockSize
+	end := start + BlockSize
+	if end > file.Size {
+		end = file.Size
+	}
+	if start >= end {
+		return nil, fmt.Errorf("block %d is past the end of %s", blockIndex, file.Name)
+	}
+
+	ConnSem.Acquire()
+	defer ConnSem.Release()
+
+	req, _ := http.NewRequest("GET", file.DownloadUrl(), nil)
+	rangeHeader := fmt.Sprintf("bytes=%d-%d", start, end-1)
+	req.Header.Add("Range", rangeHeader)
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			req.Header.Add("Range", rangeHeader)
+			return nil
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status fetching block %d of %s: %s", blockIndex, file.Name, resp.Status)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
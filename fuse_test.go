@@ -0,0 +1,94 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import "testing"
+
+func TestBlockCachePerFileCapEvictsOldestBlockOfThatFile(t *testing.T) {
+	c := newBlockCache(2, 1000)
+
+	c.put(cacheKey{fileId: 1, block: 0}, []byte("a"))
+	c.put(cacheKey{fileId: 1, block: 1}, []byte("b"))
+	c.put(cacheKey{fileId: 1, block: 2}, []byte("c"))
+
+	if _, ok := c.get(cacheKey{fileId: 1, block: 0}); ok {
+		t.Error("expected block 0 to be evicted once the per-file cap was exceeded")
+	}
+	if _, ok := c.get(cacheKey{fileId: 1, block: 1}); !ok {
+		t.Error("expected block 1 to still be cached")
+	}
+	if _, ok := c.get(cacheKey{fileId: 1, block: 2}); !ok {
+		t.Error("expected block 2 to still be cached")
+	}
+}
+
+func TestBlockCachePerFileCapDoesNotEvictOtherFiles(t *testing.T) {
+	c := newBlockCache(1, 1000)
+
+	c.put(cacheKey{fileId: 1, block: 0}, []byte("a"))
+	c.put(cacheKey{fileId: 2, block: 0}, []byte("b"))
+	c.put(cacheKey{fileId: 1, block: 1}, []byte("c"))
+
+	if _, ok := c.get(cacheKey{fileId: 1, block: 0}); ok {
+		t.Error("expected file 1's first block to be evicted")
+	}
+	if _, ok := c.get(cacheKey{fileId: 2, block: 0}); !ok {
+		t.Error("expected file 2's block to be unaffected by file 1's cap")
+	}
+}
+
+func TestBlockCacheGlobalCapEvictsLeastRecentlyUsedAcrossFiles(t *testing.T) {
+	c := newBlockCache(10, 2)
+
+	c.put(cacheKey{fileId: 1, block: 0}, []byte("a"))
+	c.put(cacheKey{fileId: 2, block: 0}, []byte("b"))
+	// Global cap of 2 bytes is now full; adding a third byte-sized block
+	// should evict the globally least-recently-used one (file 1's block).
+	c.put(cacheKey{fileId: 3, block: 0}, []byte("c"))
+
+	if _, ok := c.get(cacheKey{fileId: 1, block: 0}); ok {
+		t.Error("expected file 1's block to be evicted as the global LRU")
+	}
+	if _, ok := c.get(cacheKey{fileId: 2, block: 0}); !ok {
+		t.Error("expected file 2's block to still be cached")
+	}
+	if _, ok := c.get(cacheKey{fileId: 3, block: 0}); !ok {
+		t.Error("expected file 3's block to still be cached")
+	}
+}
+
+func TestBlockCacheGetRefreshesRecency(t *testing.T) {
+	c := newBlockCache(10, 2)
+
+	c.put(cacheKey{fileId: 1, block: 0}, []byte("a"))
+	c.put(cacheKey{fileId: 2, block: 0}, []byte("b"))
+
+	// Touching file 1's block makes file 2's the least-recently-used one.
+	if _, ok := c.get(cacheKey{fileId: 1, block: 0}); !ok {
+		t.Fatal("expected file 1's block to be cached")
+	}
+
+	c.put(cacheKey{fileId: 3, block: 0}, []byte("c"))
+
+	if _, ok := c.get(cacheKey{fileId: 2, block: 0}); ok {
+		t.Error("expected file 2's block to be evicted after file 1's was touched more recently")
+	}
+	if _, ok := c.get(cacheKey{fileId: 1, block: 0}); !ok {
+		t.Error("expected file 1's block to survive since it was just touched")
+	}
+}
+
+func TestRecordAccessIsSequential(t *testing.T) {
+	c := newBlockCache(10, 1000)
+
+	if c.recordAccessIsSequential(1, 0, 0) {
+		t.Error("expected the first access to a file to not count as sequential")
+	}
+	if !c.recordAccessIsSequential(1, 1, 1) {
+		t.Error("expected an access continuing right after the last one to be sequential")
+	}
+	if c.recordAccessIsSequential(1, 5, 5) {
+		t.Error("expected a non-contiguous access to not be sequential")
+	}
+}
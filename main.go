@@ -2,11 +2,11 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/user"
 	"path"
+	"sort"
 	"sync"
 	"time"
 )
@@ -14,25 +14,66 @@ import (
 // Settings
 
 var (
-	RemoteFolderName = flag.String("putio-folder", "Putio Desktop", "putio folder name under your root")
-	AccessToken      = flag.String("oauth-token", "", "Oauth Token")
-	LocalFolderPath  = flag.String("local-path", "~/Putio Desktop", "local folder to fetch")
-	CheckInterval    = flag.Int("check-minutes", 5, "check interval of remote files in put.io")
+	RemoteFolderName    = flag.String("putio-folder", "Putio Desktop", "putio folder name under your root")
+	AccessToken         = flag.String("oauth-token", "", "Oauth Token")
+	LocalFolderPath     = flag.String("local-path", "~/Putio Desktop", "local folder to fetch")
+	CheckInterval       = flag.Int("check-minutes", 5, "check interval of remote files in put.io")
+	MaxConcurrentFiles  = flag.Int("max-concurrent-files", 4, "maximum number of files downloaded at once")
+	MaxConnectionsTotal = flag.Int("max-connections-total", 40, "maximum number of range connections open at once, across all files")
+	MaxRetryAttempts    = flag.Int("max-attempts", 5, "maximum number of retries for a range before giving up on it")
+	NoProgress          = flag.Bool("no-progress", false, "disable the multi-bar progress UI and fall back to a single summary line")
+
+	Mount                  = flag.Bool("mount", false, "mount the remote folder as a read-only FUSE filesystem instead of syncing")
+	MountPath              = flag.String("mount-path", "", "local path to mount the remote folder at, required with --mount")
+	MaxCachedBlocksPerFile = flag.Int("mount-cache-blocks-per-file", 64, "maximum number of 1MiB blocks cached per open file in --mount mode")
+	MaxCacheBytes          = flag.Int64("mount-cache-bytes", 512*1024*1024, "maximum total bytes of blocks cached across all open files in --mount mode")
+
+	ManifestPath = flag.String("manifest", "", "path to a YAML or JSON manifest of include/exclude patterns, priority and destination overrides; reloaded on SIGHUP")
 )
 
 // Globals
 
 var (
-	RemoteFolderId  int
-	TotalDownloaded int64
-	TotalToDownload int64
-	TotalFilesSize  int64
+	RemoteFolderId         int
+	TotalDownloaded        int64
+	TotalToDownload        int64
+	TotalFilesSize         int64
+	TotalChecksumMismatch  int64
+	TotalRetries           int64
+	TotalPermanentlyFailed int64
+
+	// FileSem bounds how many DownloadFile calls run at once. ConnSem bounds
+	// the sum of active DownloadRange goroutines across the whole process.
+	FileSem Semaphore
+	ConnSem Semaphore
 )
 
 // Download functions
 
-func WalkAndDownload(parentId int, folderPath string, runWg *sync.WaitGroup, reportCh chan Report) {
-	defer runWg.Done()
+// pendingFile is a file WalkAndDownload decided to fetch, along with the
+// manifest priority it should be scheduled with.
+type pendingFile struct {
+	file     File
+	path     string
+	priority int
+}
+
+// downloadPlan accumulates the pendingFiles a walk turns up, so they can be
+// scheduled by priority once the whole tree has been walked instead of in
+// tree-walk order.
+type downloadPlan struct {
+	mu      sync.Mutex
+	pending []pendingFile
+}
+
+func (p *downloadPlan) add(file File, path string, priority int) {
+	p.mu.Lock()
+	p.pending = append(p.pending, pendingFile{file: file, path: path, priority: priority})
+	p.mu.Unlock()
+}
+
+func WalkAndDownload(parentId int, folderPath string, relPath string, walkWg *sync.WaitGroup, reportCh chan Report, plan *downloadPlan) {
+	defer walkWg.Done()
 	log.Println("Walking in:", folderPath)
 
 	// Creating if the folder is absent
@@ -52,15 +93,25 @@ func WalkAndDownload(parentId int, folderPath string, runWg *sync.WaitGroup, rep
 	}
 
 	for _, file := range files {
-		path := path.Join(folderPath, file.Name)
+		childRelPath := path.Join(relPath, file.Name)
+		localPath := path.Join(folderPath, file.Name)
 		if file.ContentType == "application/x-directory" {
-			runWg.Add(1)
-			go WalkAndDownload(file.Id, path, runWg, reportCh)
+			walkWg.Add(1)
+			go WalkAndDownload(file.Id, localPath, childRelPath, walkWg, reportCh, plan)
 		} else {
+			decision := Decide(childRelPath, file.Size)
+			if !decision.Include {
+				continue
+			}
+
+			destPath := localPath
+			if decision.Destination != "" {
+				destPath = path.Join(decision.Destination, childRelPath)
+			}
+
 			reportCh <- Report{FilesSize: file.Size}
-			if _, err := os.Stat(path); err != nil {
-				runWg.Add(1)
-				go DownloadFile(file, path, runWg, reportCh)
+			if _, err := os.Stat(destPath); err != nil {
+				plan.add(file, destPath, decision.Priority)
 			}
 		}
 	}
@@ -70,67 +121,89 @@ func StartWalkAndDownloadClearReports(RemoteFolderId int, reportCh chan Report)
 	TotalFilesSize = 0
 	TotalDownloaded = 0
 	TotalToDownload = 0
-	var runWg sync.WaitGroup
-	runWg.Add(1)
-	go WalkAndDownload(RemoteFolderId, *LocalFolderPath, &runWg, reportCh)
-	runWg.Wait()
-}
 
-type Report struct {
-	Downloaded int64
-	ToDownload int64
-	FilesSize  int64
-}
-
-func HumanReadableSpeed(bytePerSec float64) string {
-	if bytePerSec > 1024*1024 {
-		return fmt.Sprintf("%5.2f MB/s", bytePerSec/(1024*1024))
-	} else if bytePerSec > 1024 {
-		return fmt.Sprintf("%5.1f KB/s", bytePerSec/1024)
-	} else {
-		return fmt.Sprintf("%5.0f B/s ", bytePerSec)
+	plan := &downloadPlan{}
+	var walkWg sync.WaitGroup
+	walkWg.Add(1)
+	go WalkAndDownload(RemoteFolderId, *LocalFolderPath, "", &walkWg, reportCh, plan)
+	walkWg.Wait()
+
+	// Scheduling pending downloads by manifest priority (higher first)
+	// rather than tree-walk order.
+	sort.SliceStable(plan.pending, func(i, j int) bool {
+		return plan.pending[i].priority > plan.pending[j].priority
+	})
+
+	var downloadWg sync.WaitGroup
+	for _, pending := range plan.pending {
+		// Acquiring here, before spawning, so higher-priority files claim a
+		// slot in priority order; only the download itself runs concurrently.
+		FileSem.Acquire()
+		downloadWg.Add(1)
+		go func(pending pendingFile) {
+			defer FileSem.Release()
+			DownloadFile(pending.file, pending.path, &downloadWg, reportCh)
+		}(pending)
 	}
+	downloadWg.Wait()
 }
 
-func Reporter(reportCh chan Report) {
-	lastRecordedTime := time.Now()
-	lastRecordedTotalDownloaded := int64(0)
-	minReportTime := 1 * time.Second
-	log.Println("Reporter started")
-
-	for report := range reportCh {
-		TotalDownloaded += report.Downloaded
-		TotalToDownload += report.ToDownload
-		TotalFilesSize += report.FilesSize
-		currentTime := time.Now()
-		lastReportTimeDifference := currentTime.Sub(lastRecordedTime)
-		if lastReportTimeDifference > minReportTime {
-			remainingDownload := TotalToDownload - TotalDownloaded
-			syncPercentage := 100 - (float32(remainingDownload) / float32(TotalFilesSize) * 100)
-			completePercentage := float32(TotalDownloaded) / float32(TotalToDownload) * 100
-			speed := (float64(TotalDownloaded) - float64(lastRecordedTotalDownloaded)) / lastReportTimeDifference.Seconds()
-			fmt.Printf("[ Downloads %% %2.0f - %s ]   [ Sync: %% %5.2f ]\r", completePercentage, HumanReadableSpeed(speed), syncPercentage)
-			lastRecordedTime = currentTime
-			lastRecordedTotalDownloaded = TotalDownloaded
-		}
+// ReportEvent marks a lifecycle transition of a single file's download, so
+// Reporter knows when to add or remove its progress bar.
+type ReportEvent int
 
-	}
-}
+const (
+	NoEvent ReportEvent = iota
+	FileStarted
+	FileFinished
+	FileFailed
+)
 
-func StartReporter() chan Report {
-	reportCh := make(chan Report)
-	go Reporter(reportCh)
-	return reportCh
+type Report struct {
+	Downloaded        int64
+	ToDownload        int64
+	FilesSize         int64
+	ChecksumMismatch  int64
+	Retries           int64
+	PermanentlyFailed int64
+
+	FileId   int
+	FileName string
+	FileSize int64
+	Event    ReportEvent
 }
 
 func main() {
 	log.Println("Starting...")
 	flag.Parse()
 
-	RemoteFolderId, err := GetRemoteFolderId()
+	FileSem = NewSemaphore(*MaxConcurrentFiles)
+	ConnSem = NewSemaphore(*MaxConnectionsTotal)
+
+	if *ManifestPath != "" {
+		m, err := LoadManifest(*ManifestPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		SetManifest(m)
+		go WatchManifestReload(*ManifestPath)
+	}
+
+	remoteFolderId, err := GetRemoteFolderId()
 	if err != nil {
 		log.Fatal(err)
 	}
+	RemoteFolderId = remoteFolderId
+
+	if *Mount {
+		if *MountPath == "" {
+			log.Fatal("--mount-path is required with --mount")
+		}
+		if err := RunFuseMount(*MountPath); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	// If local folder path is left at default value, find os users home directory
 	// and name "Putio Folder" as the local folder path under it
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ManifestEntry configures how one set of remote paths should be synced:
+// whether to include or exclude them, the priority their files are
+// downloaded with, where to put them locally, and size bounds. Include is
+// a glob matched against a file's path relative to RemoteFolderName.
+type ManifestEntry struct {
+	Include     string `yaml:"include" json:"include"`
+	Exclude     bool   `yaml:"exclude" json:"exclude"`
+	Priority    int    `yaml:"priority" json:"priority"`
+	Destination string `yaml:"destination" json:"destination"`
+	MinSize     int64  `yaml:"min_size" json:"min_size"`
+	MaxSize     int64  `yaml:"max_size" json:"max_size"`
+}
+
+// Manifest is the selective-sync configuration read from --manifest.
+// Entries are evaluated in order and the last matching one wins, so more
+// specific overrides should be listed after broader ones.
+type Manifest struct {
+	Entries []ManifestEntry `yaml:"entries" json:"entries"`
+}
+
+var (
+	manifestMu      sync.RWMutex
+	currentManifest *Manifest
+)
+
+// LoadManifest reads and parses a manifest file, choosing JSON or YAML
+// based on its extension.
+func LoadManifest(path string) (*Manifest, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		err = json.Unmarshal(data, m)
+	} else {
+		err = yaml.Unmarshal(data, m)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SetManifest installs m as the manifest consulted by Decide.
+func SetManifest(m *Manifest) {
+	manifestMu.Lock()
+	currentManifest = m
+	manifestMu.Unlock()
+}
+
+func currentManifestEntries() []ManifestEntry {
+	manifestMu.RLock()
+	defer manifestMu.RUnlock()
+	if currentManifest == nil {
+		return nil
+	}
+	return currentManifest.Entries
+}
+
+// Decision is what the manifest says about one remote file.
+type Decision struct {
+	Include     bool
+	Priority    int
+	Destination string
+}
+
+// Decide evaluates relPath (a file's path relative to RemoteFolderName) and
+// its size against the manifest's entries. With no manifest loaded, or no
+// matching entry, the file is included at priority 0 with no destination
+// override.
+func Decide(relPath string, size int64) Decision {
+	decision := Decision{Include: true}
+
+	for _, entry := range currentManifestEntries() {
+		matched, err := filepath.Match(entry.Include, relPath)
+		if err != nil || !matched {
+			continue
+		}
+		if entry.MinSize > 0 && size < entry.MinSize {
+			continue
+		}
+		if entry.MaxSize > 0 && size > entry.MaxSize {
+			continue
+		}
+
+		decision.Include = !entry.Exclude
+		decision.Priority = entry.Priority
+		if entry.Destination != "" {
+			decision.Destination = entry.Destination
+		}
+	}
+	return decision
+}
+
+// WatchManifestReload reloads the manifest at manifestPath every time the
+// process receives SIGHUP, so a running daemon can pick up edited
+// include/exclude rules without a restart.
+func WatchManifestReload(manifestPath string) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	for range sigCh {
+		m, err := LoadManifest(manifestPath)
+		if err != nil {
+			log.Println("Could not reload manifest:", err)
+			continue
+		}
+		SetManifest(m)
+		log.Println("Reloaded manifest:", manifestPath)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import "testing"
+
+func TestDecide(t *testing.T) {
+	cases := []struct {
+		name     string
+		manifest *Manifest
+		relPath  string
+		size     int64
+		want     Decision
+	}{
+		{
+			name:     "no manifest loaded includes everything at priority 0",
+			manifest: nil,
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: true},
+		},
+		{
+			name:     "no matching entry includes at priority 0",
+			manifest: &Manifest{Entries: []ManifestEntry{{Include: "Music/*", Priority: 5}}},
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: true},
+		},
+		{
+			name:     "matching entry applies its priority and destination",
+			manifest: &Manifest{Entries: []ManifestEntry{{Include: "Movies/*", Priority: 5, Destination: "/mnt/movies"}}},
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: true, Priority: 5, Destination: "/mnt/movies"},
+		},
+		{
+			name:     "exclude entry wins",
+			manifest: &Manifest{Entries: []ManifestEntry{{Include: "Movies/*", Exclude: true}}},
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: false},
+		},
+		{
+			name: "later broader entry overrides an earlier higher-priority match",
+			manifest: &Manifest{Entries: []ManifestEntry{
+				{Include: "foo.mkv", Priority: 10},
+				{Include: "*", Priority: 1},
+			}},
+			relPath: "foo.mkv",
+			size:    100,
+			want:    Decision{Include: true, Priority: 1},
+		},
+		{
+			name:     "below MinSize does not match",
+			manifest: &Manifest{Entries: []ManifestEntry{{Include: "Movies/*", MinSize: 1000, Priority: 5}}},
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: true},
+		},
+		{
+			name:     "above MaxSize does not match",
+			manifest: &Manifest{Entries: []ManifestEntry{{Include: "Movies/*", MaxSize: 50, Priority: 5}}},
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: true},
+		},
+		{
+			name:     "within MinSize/MaxSize bounds matches",
+			manifest: &Manifest{Entries: []ManifestEntry{{Include: "Movies/*", MinSize: 50, MaxSize: 1000, Priority: 5}}},
+			relPath:  "Movies/foo.mkv",
+			size:     100,
+			want:     Decision{Include: true, Priority: 5},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			SetManifest(c.manifest)
+			defer SetManifest(nil)
+
+			got := Decide(c.relPath, c.size)
+			if got != c.want {
+				t.Errorf("Decide(%q, %d) = %+v, want %+v", c.relPath, c.size, got, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/cheggaaa/pb"
+	"github.com/mattn/go-isatty"
+)
+
+// Reporter consumes Reports from reportCh and renders them as a multi-bar
+// terminal UI: one bar per active DownloadFile plus a "Total" bar
+// aggregating all of them. It falls back to SimpleReporter when stdout
+// isn't a TTY or --no-progress was passed, since pb's bars assume a real
+// terminal to redraw themselves on.
+func Reporter(reportCh chan Report) {
+	if *NoProgress || !isatty.IsTerminal(os.Stdout.Fd()) {
+		SimpleReporter(reportCh)
+		return
+	}
+
+	pool, err := pb.StartPool()
+	if err != nil {
+		log.Println("Could not start progress UI, falling back to plain output:", err)
+		SimpleReporter(reportCh)
+		return
+	}
+	defer pool.Stop()
+	log.Println("Reporter started")
+
+	totalBar := pb.New64(0)
+	totalBar.Prefix("Total")
+	totalBar.SetUnits(pb.U_BYTES)
+	totalBar.ShowSpeed = true
+	pool.Add(totalBar)
+
+	bars := map[int]*pb.ProgressBar{}
+
+	for report := range reportCh {
+		TotalDownloaded += report.Downloaded
+		TotalToDownload += report.ToDownload
+		TotalFilesSize += report.FilesSize
+		TotalChecksumMismatch += report.ChecksumMismatch
+		TotalRetries += report.Retries
+		TotalPermanentlyFailed += report.PermanentlyFailed
+
+		totalBar.Total += report.ToDownload
+		totalBar.Add64(report.Downloaded)
+
+		switch report.Event {
+		case FileStarted:
+			bar := pb.New64(report.FileSize)
+			bar.Prefix(report.FileName)
+			bar.SetUnits(pb.U_BYTES)
+			bar.ShowSpeed = true
+			bars[report.FileId] = bar
+			pool.Add(bar)
+		case FileFinished, FileFailed:
+			if bar, ok := bars[report.FileId]; ok {
+				bar.Finish()
+				delete(bars, report.FileId)
+			}
+		default:
+			if bar, ok := bars[report.FileId]; ok {
+				bar.Add64(report.Downloaded)
+			}
+		}
+	}
+}
+
+// SimpleReporter is the original single \r summary line, used when the
+// multi-bar UI can't or shouldn't be used.
+func SimpleReporter(reportCh chan Report) {
+	lastRecordedTime := time.Now()
+	lastRecordedTotalDownloaded := int64(0)
+	minReportTime := 1 * time.Second
+	log.Println("Reporter started")
+
+	for report := range reportCh {
+		TotalDownloaded += report.Downloaded
+		TotalToDownload += report.ToDownload
+		TotalFilesSize += report.FilesSize
+		TotalChecksumMismatch += report.ChecksumMismatch
+		if report.ChecksumMismatch > 0 {
+			log.Println("Checksum mismatches so far:", TotalChecksumMismatch)
+		}
+		TotalRetries += report.Retries
+		TotalPermanentlyFailed += report.PermanentlyFailed
+		if report.PermanentlyFailed > 0 {
+			log.Println("Permanently failed ranges so far:", TotalPermanentlyFailed)
+		}
+		currentTime := time.Now()
+		lastReportTimeDifference := currentTime.Sub(lastRecordedTime)
+		if lastReportTimeDifference > minReportTime {
+			remainingDownload := TotalToDownload - TotalDownloaded
+			syncPercentage := 100 - (float32(remainingDownload) / float32(TotalFilesSize) * 100)
+			completePercentage := float32(TotalDownloaded) / float32(TotalToDownload) * 100
+			speed := (float64(TotalDownloaded) - float64(lastRecordedTotalDownloaded)) / lastReportTimeDifference.Seconds()
+			fmt.Printf("[ Downloads %% %2.0f - %s ]   [ Sync: %% %5.2f ]\r", completePercentage, HumanReadableSpeed(speed), syncPercentage)
+			lastRecordedTime = currentTime
+			lastRecordedTotalDownloaded = TotalDownloaded
+		}
+
+	}
+}
+
+func HumanReadableSpeed(bytePerSec float64) string {
+	if bytePerSec > 1024*1024 {
+		return fmt.Sprintf("%5.2f MB/s", bytePerSec/(1024*1024))
+	} else if bytePerSec > 1024 {
+		return fmt.Sprintf("%5.1f KB/s", bytePerSec/1024)
+	} else {
+		return fmt.Sprintf("%5.0f B/s ", bytePerSec)
+	}
+}
+
+func StartReporter() chan Report {
+	reportCh := make(chan Report)
+	go Reporter(reportCh)
+	return reportCh
+}
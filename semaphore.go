@@ -0,0 +1,21 @@
+package main
+
+// Semaphore bounds how many callers may hold it at once. It's used to turn
+// the otherwise unbounded fan-out of file walks and range downloads into a
+// stable, tunable worker pool.
+type Semaphore chan struct{}
+
+// NewSemaphore creates a Semaphore allowing up to n concurrent holders.
+func NewSemaphore(n int) Semaphore {
+	return make(Semaphore, n)
+}
+
+// Acquire blocks until a slot is available.
+func (s Semaphore) Acquire() {
+	s <- struct{}{}
+}
+
+// Release frees up a slot.
+func (s Semaphore) Release() {
+	<-s
+}